@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/bblfsh/server/daemon"
+	"github.com/bblfsh/server/runtime"
+
+	"github.com/sirupsen/logrus"
+)
+
+// version is set at build time via -ldflags.
+var version = "undefined"
+
+func main() {
+	address := flag.String("address", "0.0.0.0:9432", "address to listen on")
+	transport := flag.String("transport", "docker", "transport used to fetch driver images")
+	storage := flag.String("storage", "/var/lib/bblfshd", "root directory for driver images and containers")
+	flag.Parse()
+
+	r, err := runtime.NewRuntime(*storage)
+	if err != nil {
+		logrus.Fatalf("error initializing runtime: %s", err)
+	}
+
+	d := daemon.NewDaemon(version, r)
+	d.Transport = *transport
+
+	// Install the signal trap before the blocking Start call below so a
+	// SIGINT/SIGTERM received during startup is still handled.
+	trapSignals(d)
+
+	logrus.Infof("starting bblfshd %s at %s", version, *address)
+	if err := d.Start("tcp", *address); err != nil {
+		logrus.Errorf("error starting daemon: %s", err)
+		os.Exit(1)
+	}
+}
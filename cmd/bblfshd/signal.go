@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/bblfsh/server/daemon"
+
+	"github.com/sirupsen/logrus"
+)
+
+// trapSignals installs a handler for SIGINT/SIGTERM that triggers a
+// graceful drain of d on the first signal and force-exits once the signal
+// has been received three times, mirroring the trap used by Docker's engine.
+func trapSignals(d *daemon.Daemon) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		var count int
+		for range sig {
+			count++
+			if count >= 3 {
+				logrus.Warning("received signal 3 times, forcing exit")
+				os.Exit(1)
+			}
+
+			if count > 1 {
+				logrus.Warning("received signal again, already draining")
+				continue
+			}
+
+			logrus.Info("received signal, draining in-flight requests...")
+			go func() {
+				if err := d.Stop(); err != nil {
+					logrus.Errorf("error during graceful shutdown: %s", err)
+					os.Exit(1)
+				}
+
+				os.Exit(0)
+			}()
+		}
+	}()
+}
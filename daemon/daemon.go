@@ -2,10 +2,16 @@ package daemon
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	goruntime "runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/bblfsh/server/daemon/management"
 	"github.com/bblfsh/server/runtime"
 
 	"github.com/sirupsen/logrus"
@@ -16,15 +22,78 @@ import (
 
 const (
 	defaultTransport = "docker"
+
+	// defaultParseTimeout and defaultNativeParseTimeout bound how long a
+	// Parse/NativeParse request waits for a pooled driver and its response
+	// when the caller did not set its own context deadline.
+	defaultParseTimeout       = 5 * time.Second
+	defaultNativeParseTimeout = 5 * time.Second
 )
 
+// contextKey is a private type for context values set by the daemon, so
+// they cannot collide with keys set by other packages.
+type contextKey string
+
+const requestIDKey contextKey = "request-id"
+
 var (
 	ErrUnexpected       = errors.NewKind("unexpected error")
 	ErrMissingDriver    = errors.NewKind("missing driver for language %s")
 	ErrRuntime          = errors.NewKind("runtime failure")
 	ErrAlreadyInstalled = errors.NewKind("driver already installed: %s (image reference: %s)")
+	ErrNotInstalled     = errors.NewKind("driver not installed for language %s")
+	ErrDraining         = errors.NewKind("daemon is shutting down, retry later")
 )
 
+// defaultShutdownTimeout bounds how long Stop waits for in-flight parses to
+// finish before stopping driver pools regardless.
+const defaultShutdownTimeout = 30 * time.Second
+
+// PoolPolicy controls the elastic sizing behavior of a DriverPool: how many
+// instances to keep around, how eagerly to grow under load, and how
+// aggressively to shrink back down once idle.
+type PoolPolicy struct {
+	// Min is the minimum number of driver instances kept running at all
+	// times.
+	Min int
+	// Max is the maximum number of driver instances the pool may grow to.
+	Max int
+	// TargetQueueLength is the queued-request depth the pool tries to stay
+	// under by spawning new instances, up to Max.
+	TargetQueueLength int
+	// IdleTTL is how long an instance may sit idle before it becomes
+	// eligible to be stopped and removed, as long as the pool stays
+	// above Min.
+	IdleTTL time.Duration
+	// SpawnCooldown is the minimum time between two consecutive spawns,
+	// to avoid thrashing under bursty load.
+	SpawnCooldown time.Duration
+}
+
+// defaultPoolPolicy is the policy new pools get when none is specified.
+func defaultPoolPolicy() PoolPolicy {
+	return PoolPolicy{
+		Min:               1,
+		Max:               4,
+		TargetQueueLength: 1,
+		IdleTTL:           5 * time.Minute,
+		SpawnCooldown:     2 * time.Second,
+	}
+}
+
+// DriverInfo holds the installed state of a driver for a given language, as
+// reported by ListDrivers.
+type DriverInfo struct {
+	// Language is the language the driver handles.
+	Language string
+	// Reference is the image reference the driver was installed from.
+	Reference string
+	// Version is the resolved version of the installed driver.
+	Version string
+	// Status is a human readable status for the driver's pool, e.g. "running".
+	Status string
+}
+
 // Daemon is a Babelfish server.
 type Daemon struct {
 	server.Server
@@ -33,29 +102,52 @@ type Daemon struct {
 	// - docker: uses Docker registries (docker.io by default).
 	// - docker-daemon: gets images from a local Docker daemon.
 	Transport string
-	// Overrides for images per language
+	// Overrides for images per language. Keys may be either a bare language
+	// ("python") to override the image regardless of version, or a
+	// language@version pair ("python@v1.2.3") to override a specific pinned
+	// version only.
 	Overrides map[string]string
-
-	version string
-	runtime *runtime.Runtime
-	mutex   sync.RWMutex
-	pool    map[string]*DriverPool
+	// ParseTimeout and NativeParseTimeout bound how long Parse/NativeParse
+	// wait on a driver when the incoming context has no deadline of its
+	// own. They default to defaultParseTimeout/defaultNativeParseTimeout.
+	ParseTimeout       time.Duration
+	NativeParseTimeout time.Duration
+	// ShutdownTimeout bounds how long Stop waits for in-flight parses to
+	// drain before it calls Stop on the driver pools; each pool's Stop then
+	// waits up to defaultShutdownTimeout more. Defaults to
+	// defaultShutdownTimeout.
+	ShutdownTimeout time.Duration
+	// DefaultPoolPolicy is the PoolPolicy used for languages installed
+	// without an explicit one.
+	DefaultPoolPolicy PoolPolicy
+
+	version  string
+	runtime  *runtime.Runtime
+	mutex    sync.RWMutex
+	pool     map[string]*DriverPool
+	images   map[string]string
+	draining int32
 }
 
 // NewDaemon creates a new server based on the runtime with the given version.
 func NewDaemon(version string, r *runtime.Runtime) *Daemon {
 	d := &Daemon{
-		version:   version,
-		runtime:   r,
-		pool:      make(map[string]*DriverPool),
-		Overrides: make(map[string]string),
+		version:           version,
+		runtime:           r,
+		pool:              make(map[string]*DriverPool),
+		images:            make(map[string]string),
+		Overrides:         make(map[string]string),
+		DefaultPoolPolicy: defaultPoolPolicy(),
 	}
 
 	protocol.DefaultService = d
+	management.DefaultService = d
 	return d
 }
 
-func (d *Daemon) AddDriver(language string, img string) error {
+// AddDriver installs img for language and starts its pool, sized according
+// to policy. A nil policy falls back to d.DefaultPoolPolicy.
+func (d *Daemon) AddDriver(language string, img string, policy *PoolPolicy) error {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 
@@ -63,6 +155,16 @@ func (d *Daemon) AddDriver(language string, img string) error {
 		return ErrAlreadyInstalled.New(language, img)
 	}
 
+	return d.addDriver(language, img, policy)
+}
+
+// addDriver installs and starts the pool for a language, assuming d.mutex is
+// already held by the caller.
+func (d *Daemon) addDriver(language string, img string, policy *PoolPolicy) error {
+	if atomic.LoadInt32(&d.draining) == 1 {
+		return ErrDraining.New()
+	}
+
 	image, err := runtime.NewDriverImage(img)
 	if err != nil {
 		return ErrRuntime.Wrap(err)
@@ -93,9 +195,155 @@ func (d *Daemon) AddDriver(language string, img string) error {
 	dp.Logger = logrus.WithFields(logrus.Fields{
 		"language": language,
 	})
+	dp.Reference = img
+	dp.DriverVersion = driverVersion(img)
+	dp.ImageDigest = image.Digest()
+	dp.SetPolicy(d.resolvePolicy(policy))
+
+	if err := dp.Start(); err != nil {
+		return err
+	}
 
 	d.pool[language] = dp
-	return dp.Start()
+	d.images[language] = img
+	return nil
+}
+
+// ListDrivers returns the installed state of every driver currently managed
+// by the daemon.
+func (d *Daemon) ListDrivers() []*DriverInfo {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	list := make([]*DriverInfo, 0, len(d.pool))
+	for language, dp := range d.pool {
+		status := "running"
+		if dp.Closed() {
+			status = "stopped"
+		}
+
+		list = append(list, &DriverInfo{
+			Language:  language,
+			Reference: d.images[language],
+			Version:   driverVersion(d.images[language]),
+			Status:    status,
+		})
+	}
+
+	return list
+}
+
+// InstallDriver installs the driver for language, pinned to version, with a
+// pool sized according to policy (nil falls back to d.DefaultPoolPolicy). An
+// empty version installs "latest". It fails if a driver is already
+// installed for the language; use UpdateDriver to replace it.
+func (d *Daemon) InstallDriver(language, version string, policy *PoolPolicy) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if _, ok := d.pool[language]; ok {
+		return ErrAlreadyInstalled.New(language, d.images[language])
+	}
+
+	img := d.defaultDriverImageReference(language, version)
+	return d.addDriver(language, img, policy)
+}
+
+// UpdateDriver atomically replaces the driver installed for language with
+// the given version: a new pool is spawned from the new image, swapped in
+// for the language, and the old pool is drained and stopped afterwards. A
+// nil policy keeps using d.DefaultPoolPolicy.
+func (d *Daemon) UpdateDriver(language, version string, policy *PoolPolicy) error {
+	d.mutex.Lock()
+
+	old, ok := d.pool[language]
+	if !ok {
+		d.mutex.Unlock()
+		return ErrNotInstalled.New(language)
+	}
+
+	delete(d.pool, language)
+	img := d.defaultDriverImageReference(language, version)
+	if err := d.addDriver(language, img, policy); err != nil {
+		d.pool[language] = old
+		d.mutex.Unlock()
+		return err
+	}
+
+	d.mutex.Unlock()
+
+	if err := old.Stop(); err != nil {
+		return ErrRuntime.Wrap(err)
+	}
+
+	return nil
+}
+
+// SetPoolPolicy updates the elastic sizing policy of an already installed
+// language's pool. It takes effect immediately on the running pool.
+func (d *Daemon) SetPoolPolicy(language string, policy PoolPolicy) error {
+	d.mutex.RLock()
+	dp, ok := d.pool[language]
+	d.mutex.RUnlock()
+
+	if !ok {
+		return ErrNotInstalled.New(language)
+	}
+
+	dp.SetPolicy(policy)
+	return nil
+}
+
+// resolvePolicy returns policy dereferenced, or d.DefaultPoolPolicy when
+// policy is nil.
+func (d *Daemon) resolvePolicy(policy *PoolPolicy) PoolPolicy {
+	if policy != nil {
+		return *policy
+	}
+
+	return d.DefaultPoolPolicy
+}
+
+// RemoveDriver stops and uninstalls the driver for the given language.
+func (d *Daemon) RemoveDriver(language string) error {
+	d.mutex.Lock()
+
+	dp, ok := d.pool[language]
+	if !ok {
+		d.mutex.Unlock()
+		return ErrNotInstalled.New(language)
+	}
+
+	img := d.images[language]
+	delete(d.pool, language)
+	delete(d.images, language)
+	d.mutex.Unlock()
+
+	if err := dp.Stop(); err != nil {
+		return ErrRuntime.Wrap(err)
+	}
+
+	image, err := runtime.NewDriverImage(img)
+	if err != nil {
+		return ErrRuntime.Wrap(err)
+	}
+
+	if err := d.runtime.RemoveDriver(image); err != nil {
+		return ErrRuntime.Wrap(err)
+	}
+
+	return nil
+}
+
+// driverVersion extracts the version/tag part of an image reference, e.g.
+// "docker://bblfsh/python-driver:v1.2.3" returns "v1.2.3".
+func driverVersion(ref string) string {
+	idx := strings.LastIndex(ref, ":")
+	if idx == -1 {
+		return ""
+	}
+
+	return ref[idx+1:]
 }
 
 func (d *Daemon) DriverPool(language string) (*DriverPool, error) {
@@ -107,8 +355,8 @@ func (d *Daemon) DriverPool(language string) (*DriverPool, error) {
 		return dp, nil
 	}
 
-	i := d.defaultDriverImageReference(language)
-	err := d.AddDriver(language, i)
+	i := d.defaultDriverImageReference(language, "")
+	err := d.AddDriver(language, i, nil)
 	if err != nil && !ErrAlreadyInstalled.Is(err) {
 		return nil, ErrMissingDriver.Wrap(err, language)
 	}
@@ -120,42 +368,58 @@ func (d *Daemon) DriverPool(language string) (*DriverPool, error) {
 	return dp, nil
 }
 
-func (d *Daemon) Parse(req *protocol.ParseRequest) *protocol.ParseResponse {
+func (d *Daemon) Parse(ctx context.Context, req *protocol.ParseRequest) *protocol.ParseResponse {
+	ctx, cancel := d.withTimeout(ctx, d.parseTimeout())
+	defer cancel()
+
+	ctx, reqID := withRequestID(ctx)
+	log := logrus.WithField("request-id", reqID)
+
 	resp := &protocol.ParseResponse{}
+	var dp *DriverPool
 	start := time.Now()
 	defer func() {
 		resp.Elapsed = time.Since(start)
-		d.logResponse(resp.Status, req.Language, len(req.Content), resp.Elapsed)
+		d.logResponse(log, resp.Status, req.Language, len(req.Content), resp.Elapsed)
+		if dp != nil {
+			dp.RecordParse(resp.Status, resp.Elapsed)
+		}
 	}()
 
 	if req.Content == "" {
 		return resp
 	}
 
-	language, dp, err := d.selectPool(req.Language, req.Content, req.Filename)
+	language, pool, err := d.selectPool(req.Language, req.Content, req.Filename)
 	if err != nil {
-		logrus.Errorf("error selecting pool: %s", err)
+		log.Errorf("error selecting pool: %s", err)
 		resp.Response = newResponseFromError(err)
 		return resp
 	}
 
+	dp = pool
 	req.Language = language
 
-	err = dp.Execute(func(driver Driver) error {
-		resp, err = driver.Service().Parse(context.Background(), req)
+	err = dp.Execute(ctx, func(driver Driver) error {
+		resp, err = driver.Service().Parse(ctx, req)
 		return err
 	})
 
 	if err != nil {
 		resp = &protocol.ParseResponse{}
-		resp.Response = newResponseFromError(err)
+		if cerr := ctx.Err(); cerr != nil {
+			resp.Response = newResponseFromError(cerr)
+			resp.Status = protocol.Fatal
+		} else {
+			resp.Response = newResponseFromError(err)
+		}
 	}
 
 	return resp
 }
 
-func (d *Daemon) logResponse(s protocol.Status, language string, size int, elapsed time.Duration) {
-	l := logrus.WithFields(logrus.Fields{
+func (d *Daemon) logResponse(log *logrus.Entry, s protocol.Status, language string, size int, elapsed time.Duration) {
+	l := log.WithFields(logrus.Fields{
 		"language": language,
 		"elapsed":  elapsed,
 	})
@@ -172,42 +436,62 @@ func (d *Daemon) logResponse(s protocol.Status, language string, size int, elaps
 	}
 }
 
-func (d *Daemon) NativeParse(req *protocol.NativeParseRequest) *protocol.NativeParseResponse {
+func (d *Daemon) NativeParse(ctx context.Context, req *protocol.NativeParseRequest) *protocol.NativeParseResponse {
+	ctx, cancel := d.withTimeout(ctx, d.nativeParseTimeout())
+	defer cancel()
+
+	ctx, reqID := withRequestID(ctx)
+	log := logrus.WithField("request-id", reqID)
+
 	resp := &protocol.NativeParseResponse{}
+	var dp *DriverPool
 	start := time.Now()
 	defer func() {
 		resp.Elapsed = time.Since(start)
-		d.logResponse(resp.Status, req.Language, len(req.Content), resp.Elapsed)
+		d.logResponse(log, resp.Status, req.Language, len(req.Content), resp.Elapsed)
+		if dp != nil {
+			dp.RecordParse(resp.Status, resp.Elapsed)
+		}
 	}()
 
 	if req.Content == "" {
-		logrus.Debugf("empty request received, returning empty AST")
+		log.Debugf("empty request received, returning empty AST")
 		return resp
 	}
 
-	language, dp, err := d.selectPool(req.Language, req.Content, req.Filename)
+	language, pool, err := d.selectPool(req.Language, req.Content, req.Filename)
 	if err != nil {
-		logrus.Errorf("error selecting pool: %s", err)
+		log.Errorf("error selecting pool: %s", err)
 		resp.Response = newResponseFromError(err)
 		return resp
 	}
 
+	dp = pool
 	req.Language = language
 
-	err = dp.Execute(func(driver Driver) error {
-		resp, err = driver.Service().NativeParse(context.Background(), req)
+	err = dp.Execute(ctx, func(driver Driver) error {
+		resp, err = driver.Service().NativeParse(ctx, req)
 		return err
 	})
 
 	if err != nil {
 		resp = &protocol.NativeParseResponse{}
-		resp.Response = newResponseFromError(err)
+		if cerr := ctx.Err(); cerr != nil {
+			resp.Response = newResponseFromError(cerr)
+			resp.Status = protocol.Fatal
+		} else {
+			resp.Response = newResponseFromError(err)
+		}
 	}
 
 	return resp
 }
 
 func (d *Daemon) selectPool(language, content, filename string) (string, *DriverPool, error) {
+	if atomic.LoadInt32(&d.draining) == 1 {
+		return language, nil, ErrDraining.New()
+	}
+
 	if language == "" {
 		language = GetLanguage(filename, []byte(content))
 		logrus.Debugf("detected language %q, filename %q", language, filename)
@@ -225,19 +509,158 @@ func (d *Daemon) Version(req *protocol.VersionRequest) *protocol.VersionResponse
 	return &protocol.VersionResponse{Version: d.version}
 }
 
+// withTimeout returns a derived context bounded by timeout, unless ctx
+// already carries its own deadline, in which case that deadline is left
+// untouched.
+func (d *Daemon) withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if _, ok := ctx.Deadline(); ok || timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
+
+func (d *Daemon) parseTimeout() time.Duration {
+	if d.ParseTimeout > 0 {
+		return d.ParseTimeout
+	}
+
+	return defaultParseTimeout
+}
+
+func (d *Daemon) nativeParseTimeout() time.Duration {
+	if d.NativeParseTimeout > 0 {
+		return d.NativeParseTimeout
+	}
+
+	return defaultNativeParseTimeout
+}
+
+// withRequestID returns ctx carrying a request-id, reusing one already
+// present or generating a new one otherwise, mirroring the request-id
+// middleware pattern common in Docker-style engines.
+func withRequestID(ctx context.Context) (context.Context, string) {
+	if id, ok := ctx.Value(requestIDKey).(string); ok && id != "" {
+		return ctx, id
+	}
+
+	id := newRequestID()
+	return context.WithValue(ctx, requestIDKey, id), id
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// Stop performs a graceful shutdown: it first marks the daemon as draining
+// so selectPool refuses new work with a retriable ErrDraining, then waits
+// up to ShutdownTimeout for outstanding parses to complete, and finally
+// stops every pool in parallel, collecting all errors. Each pool's Stop
+// waits up to defaultShutdownTimeout more for executions still in flight
+// before stopping its instances, so Stop can take longer than
+// ShutdownTimeout.
 func (d *Daemon) Stop() error {
-	var err error
+	atomic.StoreInt32(&d.draining, 1)
+
+	d.mutex.RLock()
+	pools := make([]*DriverPool, 0, len(d.pool))
 	for _, dp := range d.pool {
-		if cerr := dp.Stop(); cerr != nil && err != nil {
-			err = cerr
+		pools = append(pools, dp)
+	}
+	d.mutex.RUnlock()
+
+	d.waitForInFlight(pools)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+
+	wg.Add(len(pools))
+	for _, dp := range pools {
+		go func(dp *DriverPool) {
+			defer wg.Done()
+
+			if err := dp.Stop(); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}(dp)
+	}
+	wg.Wait()
+
+	return newMultiError(errs)
+}
+
+// waitForInFlight blocks until every pool reports zero in-flight executions
+// or ShutdownTimeout elapses, whichever comes first.
+func (d *Daemon) waitForInFlight(pools []*DriverPool) {
+	timeout := d.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		total := 0
+		for _, dp := range pools {
+			total += dp.InFlight()
 		}
+
+		if total == 0 {
+			return
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	logrus.Warning("shutdown timeout reached with parses still in flight, stopping pools anyway")
+}
+
+// multiError aggregates zero or more errors produced while stopping driver
+// pools in parallel.
+type multiError struct {
+	errs []error
+}
+
+func newMultiError(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return &multiError{errs: errs}
+}
+
+func (m *multiError) Error() string {
+	parts := make([]string, len(m.errs))
+	for i, err := range m.errs {
+		parts[i] = err.Error()
 	}
 
-	return err
+	return strings.Join(parts, "; ")
 }
 
-// returns the default image reference for a driver given a language.
-func (s *Daemon) defaultDriverImageReference(lang string) string {
+// returns the default image reference for a driver given a language and an
+// optional pinned version. An empty version resolves to "latest". Overrides
+// are looked up first by "language@version" and then by bare "language".
+func (s *Daemon) defaultDriverImageReference(lang string, version string) string {
+	if version == "" {
+		version = "latest"
+	}
+
+	if override := s.Overrides[fmt.Sprintf("%s@%s", lang, version)]; override != "" {
+		return override
+	}
+
 	if override := s.Overrides[lang]; override != "" {
 		return override
 	}
@@ -247,7 +670,7 @@ func (s *Daemon) defaultDriverImageReference(lang string) string {
 		transport = defaultTransport
 	}
 
-	ref := fmt.Sprintf("bblfsh/%s-driver:latest", lang)
+	ref := fmt.Sprintf("bblfsh/%s-driver:%s", lang, version)
 	switch transport {
 	case "docker":
 		ref = "//" + ref
@@ -276,3 +699,49 @@ func newResponseFromError(err error) protocol.Response {
 		Errors: []string{err.Error()},
 	}
 }
+
+// Info reports the daemon's version, transport, runtime backend, and
+// per-language pool metrics as a management.InfoResponse. It is called
+// in-process through management.DefaultService; no gRPC handler serves it.
+func (d *Daemon) Info(req *management.InfoRequest) *management.InfoResponse {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	transport := d.Transport
+	if transport == "" {
+		transport = defaultTransport
+	}
+
+	overrides := make(map[string]string, len(d.Overrides))
+	for k, v := range d.Overrides {
+		overrides[k] = v
+	}
+
+	info := &management.InfoResponse{
+		Version:   d.version,
+		Transport: transport,
+		Overrides: overrides,
+		OS:        goruntime.GOOS,
+		Arch:      goruntime.GOARCH,
+		Runtime:   d.runtime.Name(),
+		Drivers:   make(map[string]*management.DriverPoolInfo, len(d.pool)),
+	}
+
+	for language, dp := range d.pool {
+		stats := dp.Stats()
+		info.Drivers[language] = &management.DriverPoolInfo{
+			Reference:     d.images[language],
+			ImageDigest:   stats.ImageDigest,
+			DriverVersion: stats.DriverVersion,
+			Instances:     stats.Instances,
+			MinPoolSize:   stats.MinPoolSize,
+			MaxPoolSize:   stats.MaxPoolSize,
+			Queued:        stats.Queued,
+			TotalParses:   stats.TotalParses,
+			Errors:        stats.Errors,
+			AvgLatency:    stats.AvgLatency,
+		}
+	}
+
+	return info
+}
@@ -0,0 +1,123 @@
+package daemon
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gopkg.in/bblfsh/sdk.v1/protocol"
+)
+
+// TestDaemonAddDriverRejectsAlreadyInstalled exercises AddDriver's locking
+// and map bookkeeping: installing a language twice must fail without ever
+// touching the runtime.
+func TestDaemonAddDriverRejectsAlreadyInstalled(t *testing.T) {
+	d := NewDaemon("test", nil)
+	dp := newFakePool(t, 1, 1)
+	defer dp.Stop()
+	d.pool["python"] = dp
+
+	err := d.AddDriver("python", "docker://bblfsh/python-driver:latest", nil)
+	if !ErrAlreadyInstalled.Is(err) {
+		t.Fatalf("expected ErrAlreadyInstalled, got %v", err)
+	}
+}
+
+// TestDaemonRemoveDriverRejectsUnknownLanguage exercises RemoveDriver's
+// not-installed path, which must fail before ever reaching the runtime.
+func TestDaemonRemoveDriverRejectsUnknownLanguage(t *testing.T) {
+	d := NewDaemon("test", nil)
+
+	if err := d.RemoveDriver("ruby"); !ErrNotInstalled.Is(err) {
+		t.Fatalf("expected ErrNotInstalled, got %v", err)
+	}
+}
+
+// TestDaemonUpdateDriverRejectsUnknownLanguage exercises UpdateDriver's
+// not-installed path the same way.
+func TestDaemonUpdateDriverRejectsUnknownLanguage(t *testing.T) {
+	d := NewDaemon("test", nil)
+
+	if err := d.UpdateDriver("ruby", "v2", nil); !ErrNotInstalled.Is(err) {
+		t.Fatalf("expected ErrNotInstalled, got %v", err)
+	}
+}
+
+// TestDaemonListDriversReflectsPoolStatus exercises ListDrivers' bookkeeping
+// end to end: installed state is reported while the pool is running, and
+// flips to "stopped" once the pool is stopped.
+func TestDaemonListDriversReflectsPoolStatus(t *testing.T) {
+	d := NewDaemon("test", nil)
+	dp := newFakePool(t, 1, 1)
+	d.pool["python"] = dp
+	d.images["python"] = "docker://bblfsh/python-driver:v1.2.3"
+
+	list := d.ListDrivers()
+	if len(list) != 1 {
+		t.Fatalf("expected 1 driver, got %d", len(list))
+	}
+
+	if list[0].Status != "running" || list[0].Version != "v1.2.3" {
+		t.Fatalf("unexpected driver info: %+v", list[0])
+	}
+
+	if err := dp.Stop(); err != nil {
+		t.Fatalf("Stop: %s", err)
+	}
+
+	list = d.ListDrivers()
+	if list[0].Status != "stopped" {
+		t.Fatalf("expected status %q after Stop, got %q", "stopped", list[0].Status)
+	}
+}
+
+// TestDaemonParseDrainsOnPoolRemoval exercises, through the Daemon-facing
+// Parse API rather than DriverPool directly, the exact sequence
+// RemoveDriver/UpdateDriver run: the pool is stopped while Parse requests
+// are still executing against it, and every one of them must still
+// complete successfully instead of losing its driver instance mid-flight.
+func TestDaemonParseDrainsOnPoolRemoval(t *testing.T) {
+	d := NewDaemon("test", nil)
+	dp, driver := newSingleInstancePool(t, 50*time.Millisecond)
+	d.pool["python"] = dp
+	d.images["python"] = "docker://bblfsh/python-driver:v1.0.0"
+
+	var wg sync.WaitGroup
+	responses := make(chan *protocol.ParseResponse, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses <- d.Parse(context.Background(), &protocol.ParseRequest{
+				Language: "python",
+				Content:  "print(1)",
+			})
+		}()
+	}
+
+	// Give the first Parse a chance to actually start running before the
+	// pool is removed concurrently with the other two still in flight,
+	// mirroring what RemoveDriver does after it deletes the map entry.
+	time.Sleep(5 * time.Millisecond)
+
+	stopErr := make(chan error, 1)
+	go func() { stopErr <- dp.Stop() }()
+
+	wg.Wait()
+	close(responses)
+	for resp := range responses {
+		if resp.Status != protocol.Ok {
+			t.Errorf("parse in flight during pool removal failed: status %s", resp.Status)
+		}
+	}
+
+	if err := <-stopErr; err != nil {
+		t.Fatalf("Stop: %s", err)
+	}
+
+	if atomic.LoadInt32(&driver.stoppedWhileRunning) != 0 {
+		t.Fatal("driver instance was stopped while a Parse call was still running against it")
+	}
+}
@@ -0,0 +1,50 @@
+// Package management defines the request/response types for bblfshd's
+// management API: operations that are not part of the core bblfsh parsing
+// protocol (gopkg.in/bblfsh/sdk.v1/protocol). Nothing registers them with a
+// gRPC transport; they are served in-process through DefaultService.
+package management
+
+import "time"
+
+// InfoRequest requests a snapshot of the daemon's runtime and pool state.
+// It carries no fields; it keeps Info in the request/response shape of the
+// protocol handlers.
+type InfoRequest struct{}
+
+// InfoResponse reports the daemon's version, transport, configured
+// overrides, host OS/arch, runtime backend, and per-language driver pool
+// metrics, analogous to `docker info`.
+type InfoResponse struct {
+	Version   string
+	Transport string
+	Overrides map[string]string
+	OS        string
+	Arch      string
+	Runtime   string
+	Drivers   map[string]*DriverPoolInfo
+}
+
+// DriverPoolInfo reports the runtime state and metrics of a single
+// language's driver pool.
+type DriverPoolInfo struct {
+	Reference     string
+	ImageDigest   string
+	DriverVersion string
+	Instances     int
+	MinPoolSize   int
+	MaxPoolSize   int
+	Queued        int
+	TotalParses   uint64
+	Errors        uint64
+	AvgLatency    time.Duration
+}
+
+// Service is implemented by anything that can report daemon info, e.g.
+// *daemon.Daemon. No gRPC handler dispatches Info calls to it.
+type Service interface {
+	Info(*InfoRequest) *InfoResponse
+}
+
+// DefaultService is the Service set by daemon.NewDaemon. It is not
+// registered with any transport.
+var DefaultService Service
@@ -0,0 +1,431 @@
+package daemon
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/bblfsh/sdk.v1/protocol"
+)
+
+// ErrPoolClosed is returned by DriverPool.Execute once the pool has been
+// stopped.
+var ErrPoolClosed = ErrUnexpected.New()
+
+// DriverService is the subset of a driver instance's RPC surface that
+// DriverPool.Execute calls into. Unlike protocol.Service, every method takes
+// a context so a caller's cancellation/deadline reaches the driver.
+type DriverService interface {
+	Parse(ctx context.Context, req *protocol.ParseRequest) (*protocol.ParseResponse, error)
+	NativeParse(ctx context.Context, req *protocol.NativeParseRequest) (*protocol.NativeParseResponse, error)
+}
+
+// Driver is a single running driver instance managed by a DriverPool.
+type Driver interface {
+	Start() error
+	Stop() error
+	Service() DriverService
+}
+
+// driverPoolStats is the raw data backing DriverPool.Stats.
+type driverPoolStats struct {
+	Reference     string
+	ImageDigest   string
+	DriverVersion string
+	Instances     int
+	MinPoolSize   int
+	MaxPoolSize   int
+	Queued        int
+	TotalParses   uint64
+	Errors        uint64
+	AvgLatency    time.Duration
+}
+
+// instance wraps a single Driver with the bookkeeping DriverPool needs to
+// hand it out and reclaim it.
+type instance struct {
+	driver   Driver
+	busy     bool
+	lastFree time.Time
+}
+
+// DriverPool manages a pool of driver instances for a single language,
+// spawned from New on demand and handed out to callers of Execute.
+type DriverPool struct {
+	// New spawns a new driver instance. It is called with no locks held, so
+	// it may block for as long as starting a driver takes.
+	New func() (Driver, error)
+	// Logger is used for pool lifecycle and error messages. Defaults to the
+	// standard logger if left nil.
+	Logger *logrus.Entry
+
+	// Reference and DriverVersion are surfaced as-is through Stats; they
+	// are set once by the caller right after construction.
+	Reference     string
+	DriverVersion string
+	ImageDigest   string
+
+	mutex     sync.Mutex
+	cond      *sync.Cond
+	instances []*instance
+	policy    PoolPolicy
+	waiting   int
+	closed    bool
+	inFlight  int32
+	spawning  bool
+	lastSpawn time.Time
+	reapDone  chan struct{}
+	reapWG    sync.WaitGroup
+
+	totalParses uint64
+	errors      uint64
+	avgLatency  time.Duration
+}
+
+// NewDriverPool creates a DriverPool that spawns instances using new. The
+// pool is not usable until Start is called.
+func NewDriverPool(new func() (Driver, error)) *DriverPool {
+	p := &DriverPool{
+		New:    new,
+		policy: defaultPoolPolicy(),
+	}
+	p.cond = sync.NewCond(&p.mutex)
+	return p
+}
+
+// SetPolicy updates the pool's elastic sizing policy. It takes effect right
+// away: queued Execute calls are woken to re-check it, and the idle reaper
+// uses it on its next tick. Raising Min does not spawn instances by itself.
+func (p *DriverPool) SetPolicy(policy PoolPolicy) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.policy = policy
+	p.cond.Broadcast()
+}
+
+// Start spawns the pool's minimum number of instances. It fails if any of
+// them fails to start.
+func (p *DriverPool) Start() error {
+	p.mutex.Lock()
+	min := p.policy.Min
+	p.mutex.Unlock()
+
+	if min < 1 {
+		min = 1
+	}
+
+	for i := 0; i < min; i++ {
+		driver, err := p.New()
+		if err != nil {
+			return ErrRuntime.Wrap(err)
+		}
+
+		p.mutex.Lock()
+		p.instances = append(p.instances, &instance{driver: driver, lastFree: time.Now()})
+		p.mutex.Unlock()
+	}
+
+	p.mutex.Lock()
+	p.reapDone = make(chan struct{})
+	p.mutex.Unlock()
+
+	p.reapWG.Add(1)
+	go p.reapIdle()
+
+	return nil
+}
+
+// Execute acquires a free driver instance, growing the pool if Execute's
+// caller is willing to wait, runs fn against it, and returns it to the pool.
+// It honors ctx.Done() while waiting for an instance, returning ctx.Err()
+// without ever running fn if the context fires first.
+func (p *DriverPool) Execute(ctx context.Context, fn func(Driver) error) error {
+	atomic.AddInt32(&p.inFlight, 1)
+	defer atomic.AddInt32(&p.inFlight, -1)
+
+	inst, err := p.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer p.release(inst)
+
+	return fn(inst.driver)
+}
+
+// acquire blocks until a free instance is available or ctx is done,
+// whichever happens first. It fails with ErrPoolClosed if the pool is
+// already closed on entry; a caller already queued when Stop runs keeps
+// waiting for an instance, and gets ErrPoolClosed only once Stop has
+// removed every instance.
+func (p *DriverPool) acquire(ctx context.Context) (*instance, error) {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.mutex.Lock()
+			p.cond.Broadcast()
+			p.mutex.Unlock()
+		case <-stop:
+		}
+	}()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return nil, ErrPoolClosed
+	}
+
+	p.waiting++
+	defer func() { p.waiting-- }()
+
+	for {
+		if p.closed && len(p.instances) == 0 {
+			return nil, ErrPoolClosed
+		}
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		for _, inst := range p.instances {
+			if !inst.busy {
+				inst.busy = true
+				return inst, nil
+			}
+		}
+
+		p.maybeSpawnLocked()
+		p.cond.Wait()
+	}
+}
+
+// maybeSpawnLocked spawns a new instance in the background when the pool is
+// fully busy, the number of callers queued for an instance exceeds
+// TargetQueueLength, it is below its Max, and it is not within SpawnCooldown
+// of its last spawn. It must be called with p.mutex held, but New itself
+// runs without it so a slow driver start does not block other waiters.
+func (p *DriverPool) maybeSpawnLocked() {
+	if p.spawning || len(p.instances) >= p.policy.Max {
+		return
+	}
+
+	if p.waiting <= p.policy.TargetQueueLength {
+		return
+	}
+
+	if !p.lastSpawn.IsZero() && time.Since(p.lastSpawn) < p.policy.SpawnCooldown {
+		return
+	}
+
+	p.spawning = true
+	p.lastSpawn = time.Now()
+
+	go func() {
+		driver, err := p.New()
+
+		p.mutex.Lock()
+		p.spawning = false
+		if err != nil {
+			p.mutex.Unlock()
+			p.logger().Errorf("error spawning driver instance: %s", err)
+			p.cond.Broadcast()
+			return
+		}
+
+		if p.closed {
+			p.mutex.Unlock()
+			driver.Stop()
+			return
+		}
+
+		p.instances = append(p.instances, &instance{driver: driver, lastFree: time.Now()})
+		p.mutex.Unlock()
+		p.cond.Broadcast()
+	}()
+}
+
+// release returns inst to the pool, making it available to the next waiter.
+func (p *DriverPool) release(inst *instance) {
+	p.mutex.Lock()
+	inst.busy = false
+	inst.lastFree = time.Now()
+	p.mutex.Unlock()
+
+	p.cond.Broadcast()
+}
+
+// reapTick is how often reapIdle checks for idle instances to stop. It is
+// independent of any one pool's IdleTTL, which may change at runtime via
+// SetPolicy.
+const reapTick = 100 * time.Millisecond
+
+// reapIdle periodically stops and removes instances that have been idle for
+// longer than policy.IdleTTL, as long as doing so keeps the pool at or above
+// policy.Min.
+func (p *DriverPool) reapIdle() {
+	defer p.reapWG.Done()
+
+	ticker := time.NewTicker(reapTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.reapDone:
+			return
+		case <-ticker.C:
+			p.reapIdleOnce()
+		}
+	}
+}
+
+// reapIdleOnce stops and removes every instance that is idle past
+// policy.IdleTTL, while keeping the pool at or above policy.Min.
+func (p *DriverPool) reapIdleOnce() {
+	for {
+		p.mutex.Lock()
+		var victim *instance
+		var victimIdx int
+
+		for i, inst := range p.instances {
+			if inst.busy || len(p.instances) <= p.policy.Min {
+				continue
+			}
+
+			if time.Since(inst.lastFree) >= p.policy.IdleTTL {
+				victim = inst
+				victimIdx = i
+				break
+			}
+		}
+
+		if victim == nil {
+			p.mutex.Unlock()
+			return
+		}
+
+		p.instances = append(p.instances[:victimIdx], p.instances[victimIdx+1:]...)
+		p.mutex.Unlock()
+
+		if err := victim.driver.Stop(); err != nil {
+			p.logger().Errorf("error stopping idle driver instance: %s", err)
+		}
+	}
+}
+
+// Stop rejects any future Execute calls with ErrPoolClosed, waits for
+// in-flight ones to finish running against their instance, and only then
+// stops every instance in the pool. It gives up waiting and stops instances
+// regardless after defaultShutdownTimeout, so a stuck driver cannot wedge
+// Stop forever.
+func (p *DriverPool) Stop() error {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return nil
+	}
+
+	p.closed = true
+	reapDone := p.reapDone
+	p.mutex.Unlock()
+	p.cond.Broadcast()
+
+	if reapDone != nil {
+		close(reapDone)
+		p.reapWG.Wait()
+	}
+
+	p.waitForDrain()
+
+	p.mutex.Lock()
+	instances := p.instances
+	p.instances = nil
+	p.mutex.Unlock()
+
+	var errs []error
+	for _, inst := range instances {
+		if err := inst.driver.Stop(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return newMultiError(errs)
+}
+
+// waitForDrain blocks until InFlight reaches zero or defaultShutdownTimeout
+// elapses, whichever comes first.
+func (p *DriverPool) waitForDrain() {
+	deadline := time.Now().Add(defaultShutdownTimeout)
+	for time.Now().Before(deadline) {
+		if p.InFlight() == 0 {
+			return
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	p.logger().Warning("stop timeout reached with executions still in flight, stopping instances anyway")
+}
+
+// InFlight returns the number of Execute calls currently in progress,
+// including ones still waiting for a free instance.
+func (p *DriverPool) InFlight() int {
+	return int(atomic.LoadInt32(&p.inFlight))
+}
+
+// RecordParse folds a completed parse's status and latency into the pool's
+// counters and EWMA latency tracker.
+func (p *DriverPool) RecordParse(status protocol.Status, elapsed time.Duration) {
+	atomic.AddUint64(&p.totalParses, 1)
+	if status != protocol.Ok {
+		atomic.AddUint64(&p.errors, 1)
+	}
+
+	const alpha = 0.2
+	p.mutex.Lock()
+	if p.avgLatency == 0 {
+		p.avgLatency = elapsed
+	} else {
+		p.avgLatency = time.Duration(float64(p.avgLatency)*(1-alpha) + float64(elapsed)*alpha)
+	}
+	p.mutex.Unlock()
+}
+
+// Stats returns a snapshot of the pool's current size and metrics.
+func (p *DriverPool) Stats() driverPoolStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return driverPoolStats{
+		Reference:     p.Reference,
+		ImageDigest:   p.ImageDigest,
+		DriverVersion: p.DriverVersion,
+		Instances:     len(p.instances),
+		MinPoolSize:   p.policy.Min,
+		MaxPoolSize:   p.policy.Max,
+		Queued:        p.waiting,
+		TotalParses:   atomic.LoadUint64(&p.totalParses),
+		Errors:        atomic.LoadUint64(&p.errors),
+		AvgLatency:    p.avgLatency,
+	}
+}
+
+// Closed reports whether the pool has been stopped.
+func (p *DriverPool) Closed() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.closed
+}
+
+func (p *DriverPool) logger() *logrus.Entry {
+	if p.Logger != nil {
+		return p.Logger
+	}
+
+	return logrus.NewEntry(logrus.StandardLogger())
+}
@@ -0,0 +1,71 @@
+package daemon
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gopkg.in/bblfsh/sdk.v1/protocol"
+)
+
+// TestDriverPoolAutoscalesUnderLoad ramps up concurrent parses against a
+// pool that starts at its minimum size and asserts it grows to serve the
+// burst without dropping any request, then shrinks back down once the load
+// quiesces and instances sit idle past IdleTTL.
+func TestDriverPoolAutoscalesUnderLoad(t *testing.T) {
+	var spawned int32
+	dp := NewDriverPool(func() (Driver, error) {
+		atomic.AddInt32(&spawned, 1)
+		return &fakeDriver{delay: 20 * time.Millisecond}, nil
+	})
+	dp.SetPolicy(PoolPolicy{
+		Min:               1,
+		Max:               8,
+		TargetQueueLength: 1,
+		IdleTTL:           50 * time.Millisecond,
+		SpawnCooldown:     0,
+	})
+
+	if err := dp.Start(); err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+	defer dp.Stop()
+
+	const concurrency = 8
+	var wg sync.WaitGroup
+	for round := 0; round < 5; round++ {
+		wg.Add(concurrency)
+		for i := 0; i < concurrency; i++ {
+			go func() {
+				defer wg.Done()
+				err := dp.Execute(context.Background(), func(d Driver) error {
+					_, err := d.Service().Parse(context.Background(), &protocol.ParseRequest{})
+					return err
+				})
+				if err != nil {
+					t.Errorf("parse dropped under load: %s", err)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	grown := dp.Stats().Instances
+	if grown <= 1 {
+		t.Fatalf("expected pool to grow above its minimum under load, got %d instances", grown)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if dp.Stats().Instances == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got := dp.Stats().Instances; got != 1 {
+		t.Fatalf("expected pool to shrink back to its minimum after quiescence, got %d instances", got)
+	}
+}
@@ -0,0 +1,280 @@
+package daemon
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gopkg.in/bblfsh/sdk.v1/protocol"
+)
+
+// fakeDriver is a Driver backed by an in-memory DriverService, used to
+// exercise DriverPool without spawning real containers. running tracks
+// whether a Parse call is currently executing against it, so tests can
+// assert Stop never tears an instance down mid-parse.
+type fakeDriver struct {
+	delay               time.Duration
+	running             int32
+	stopped             int32
+	stoppedWhileRunning int32
+}
+
+func (f *fakeDriver) Start() error { return nil }
+func (f *fakeDriver) Stop() error {
+	atomic.StoreInt32(&f.stopped, 1)
+	if atomic.LoadInt32(&f.running) != 0 {
+		atomic.StoreInt32(&f.stoppedWhileRunning, 1)
+	}
+
+	return nil
+}
+
+func (f *fakeDriver) Service() DriverService { return fakeDriverService{f} }
+
+type fakeDriverService struct{ d *fakeDriver }
+
+func (s fakeDriverService) Parse(ctx context.Context, req *protocol.ParseRequest) (*protocol.ParseResponse, error) {
+	atomic.AddInt32(&s.d.running, 1)
+	defer atomic.AddInt32(&s.d.running, -1)
+
+	if s.d.delay > 0 {
+		select {
+		case <-time.After(s.d.delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	return &protocol.ParseResponse{Response: protocol.Response{Status: protocol.Ok}}, nil
+}
+
+func (s fakeDriverService) NativeParse(ctx context.Context, req *protocol.NativeParseRequest) (*protocol.NativeParseResponse, error) {
+	return &protocol.NativeParseResponse{Response: protocol.Response{Status: protocol.Ok}}, nil
+}
+
+func newFakePool(t *testing.T, min, max int) *DriverPool {
+	t.Helper()
+
+	dp := NewDriverPool(func() (Driver, error) {
+		return &fakeDriver{delay: 10 * time.Millisecond}, nil
+	})
+	dp.SetPolicy(PoolPolicy{Min: min, Max: max, TargetQueueLength: 1, IdleTTL: time.Minute, SpawnCooldown: 0})
+	if err := dp.Start(); err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+
+	return dp
+}
+
+// newSingleInstancePool is like newFakePool but hands back the one
+// fakeDriver it spawns, so a test can inspect it after the fact.
+func newSingleInstancePool(t *testing.T, delay time.Duration) (*DriverPool, *fakeDriver) {
+	t.Helper()
+
+	driver := &fakeDriver{delay: delay}
+	dp := NewDriverPool(func() (Driver, error) { return driver, nil })
+	dp.SetPolicy(PoolPolicy{Min: 1, Max: 1, TargetQueueLength: 1, IdleTTL: time.Minute, SpawnCooldown: 0})
+	if err := dp.Start(); err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+
+	return dp, driver
+}
+
+// TestDriverPoolDrainsInFlightOnRemove mirrors removing a driver while parse
+// requests are still executing against it: Stop is called concurrently with
+// in-flight Execute calls, and must not tear the instance down until every
+// one of them has returned.
+func TestDriverPoolDrainsInFlightOnRemove(t *testing.T) {
+	dp, driver := newSingleInstancePool(t, 50*time.Millisecond)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- dp.Execute(context.Background(), func(d Driver) error {
+				_, err := d.Service().Parse(context.Background(), &protocol.ParseRequest{})
+				return err
+			})
+		}()
+	}
+
+	// Give the first Execute a chance to actually start running before
+	// Stop is called concurrently with the other two still in flight.
+	time.Sleep(5 * time.Millisecond)
+
+	stopErr := make(chan error, 1)
+	go func() { stopErr <- dp.Stop() }()
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("in-flight parse failed while pool was draining: %s", err)
+		}
+	}
+
+	if err := <-stopErr; err != nil {
+		t.Fatalf("Stop: %s", err)
+	}
+
+	if atomic.LoadInt32(&driver.stoppedWhileRunning) != 0 {
+		t.Fatal("driver instance was stopped while a parse was still running against it")
+	}
+
+	if atomic.LoadInt32(&driver.stopped) == 0 {
+		t.Fatal("expected driver instance to be stopped once drained")
+	}
+}
+
+// TestDriverPoolUpgradeSwap mirrors UpdateDriver: a new pool takes over and
+// serves a request while the old one still has parses in flight, then the
+// old one is stopped mid-drain, and every in-flight request on either pool
+// must still complete successfully.
+func TestDriverPoolUpgradeSwap(t *testing.T) {
+	old, oldDriver := newSingleInstancePool(t, 50*time.Millisecond)
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			defer wg.Done()
+			if err := old.Execute(context.Background(), func(d Driver) error {
+				_, err := d.Service().Parse(context.Background(), &protocol.ParseRequest{})
+				return err
+			}); err != nil {
+				t.Errorf("in-flight parse on old pool failed: %s", err)
+			}
+		}()
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	next := newFakePool(t, 1, 1)
+	defer next.Stop()
+
+	if err := next.Execute(context.Background(), func(d Driver) error {
+		_, err := d.Service().Parse(context.Background(), &protocol.ParseRequest{})
+		return err
+	}); err != nil {
+		t.Fatalf("parse on new pool failed: %s", err)
+	}
+
+	// Stop the old pool while its three Execute calls above may still be
+	// running; it must wait for them instead of killing the instance.
+	if err := old.Stop(); err != nil {
+		t.Fatalf("Stop old pool: %s", err)
+	}
+
+	wg.Wait()
+
+	if atomic.LoadInt32(&oldDriver.stoppedWhileRunning) != 0 {
+		t.Fatal("old pool's driver instance was stopped while a parse was still running against it")
+	}
+}
+
+// TestDriverPoolStatsReportsImageMetadata pins Reference/DriverVersion/
+// ImageDigest as passthrough fields on Stats: addDriver sets them once
+// right after construction, and Stats/Info must keep surfacing whatever
+// was set instead of silently dropping any of them.
+func TestDriverPoolStatsReportsImageMetadata(t *testing.T) {
+	dp := newFakePool(t, 1, 1)
+	defer dp.Stop()
+
+	dp.Reference = "docker://bblfsh/python-driver:v1.2.3"
+	dp.DriverVersion = "v1.2.3"
+	dp.ImageDigest = "sha256:deadbeef"
+
+	stats := dp.Stats()
+	if stats.Reference != dp.Reference {
+		t.Errorf("Reference: got %q, want %q", stats.Reference, dp.Reference)
+	}
+	if stats.DriverVersion != dp.DriverVersion {
+		t.Errorf("DriverVersion: got %q, want %q", stats.DriverVersion, dp.DriverVersion)
+	}
+	if stats.ImageDigest != dp.ImageDigest {
+		t.Errorf("ImageDigest: got %q, want %q", stats.ImageDigest, dp.ImageDigest)
+	}
+}
+
+// TestDriverPoolExecuteHonorsContext asserts a waiter gives up as soon as
+// its context is done, instead of blocking until an instance frees up.
+func TestDriverPoolExecuteHonorsContext(t *testing.T) {
+	dp := newFakePool(t, 1, 1)
+	defer dp.Stop()
+
+	release := make(chan struct{})
+	go dp.Execute(context.Background(), func(d Driver) error {
+		<-release
+		return nil
+	})
+
+	time.Sleep(5 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := dp.Execute(ctx, func(d Driver) error { return nil })
+	close(release)
+
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+// TestDriverPoolRespectsTargetQueueLength asserts maybeSpawnLocked only
+// grows the pool once the number of waiters exceeds TargetQueueLength,
+// rather than spawning as soon as every instance is busy.
+func TestDriverPoolRespectsTargetQueueLength(t *testing.T) {
+	dp := NewDriverPool(func() (Driver, error) { return &fakeDriver{}, nil })
+	dp.SetPolicy(PoolPolicy{Min: 1, Max: 4, TargetQueueLength: 2, IdleTTL: time.Minute, SpawnCooldown: 0})
+	if err := dp.Start(); err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+	defer dp.Stop()
+
+	release := make(chan struct{})
+	occupy := func() {
+		dp.Execute(context.Background(), func(d Driver) error {
+			<-release
+			return nil
+		})
+	}
+
+	go occupy()
+	time.Sleep(5 * time.Millisecond) // let it claim the pool's single instance
+
+	// These two waiters sit right at TargetQueueLength and must not trigger
+	// a spawn on their own.
+	go occupy()
+	go occupy()
+
+	deadline := time.Now().Add(200 * time.Millisecond)
+	for time.Now().Before(deadline) && dp.Stats().Queued < 2 {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if got := dp.Stats().Instances; got != 1 {
+		t.Fatalf("expected pool to stay at 1 instance while queue depth is at TargetQueueLength, got %d", got)
+	}
+
+	// A third waiter pushes the queue past TargetQueueLength, which must
+	// trigger a spawn.
+	go occupy()
+
+	deadline = time.Now().Add(200 * time.Millisecond)
+	for time.Now().Before(deadline) && dp.Stats().Instances < 2 {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if got := dp.Stats().Instances; got < 2 {
+		t.Fatalf("expected pool to grow once queue depth exceeded TargetQueueLength, got %d instances", got)
+	}
+
+	close(release)
+}